@@ -0,0 +1,106 @@
+// Package libproxytest provides an in-memory libproxy.Multiplexer, backed by
+// a virtual network of in-memory pipes, for exercising forward.Forward
+// end-to-end in tests without opening real sockets to a real remote. The
+// pipes are unbuffered net.Pipe halves joined by a relay that holds at most
+// one chunk per direction, so a Write blocks until the relay has read it.
+package libproxytest
+
+import (
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Bridge links the two ends of an in-memory connection, optionally chunking
+// writes to MTU, delaying them by Latency, or dropping a Loss fraction of
+// them, to simulate a real link between two peers in a virtual network. The
+// zero Bridge is a perfect, instantaneous, lossless link.
+type Bridge struct {
+	MTU     int
+	Latency time.Duration
+	Loss    float64 // fraction of chunks dropped in transit, 0..1
+}
+
+// pipe returns two connected Conns; bytes written to one arrive on the other
+// after passing through the bridge's MTU/latency/loss filters in each
+// direction independently.
+func (b Bridge) pipe() (*conn, *conn) {
+	a, x1 := net.Pipe()
+	bb, x2 := net.Pipe()
+	go b.relay(x1, x2)
+	go b.relay(x2, x1)
+	return &conn{Conn: a}, &conn{Conn: bb}
+}
+
+func (b Bridge) relay(src, dst net.Conn) {
+	buf := make([]byte, b.mtu())
+	for {
+		n, err := src.Read(buf)
+		if n > 0 && !(b.Loss > 0 && rand.Float64() < b.Loss) {
+			if b.Latency > 0 {
+				time.Sleep(b.Latency)
+			}
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return
+			}
+		}
+		if err != nil {
+			dst.Close()
+			return
+		}
+	}
+}
+
+func (b Bridge) mtu() int {
+	if b.MTU > 0 {
+		return b.MTU
+	}
+	return 64 * 1024
+}
+
+// conn adapts a net.Pipe half into a libproxy.Conn by adding CloseRead and
+// CloseWrite. Unlike a real socket, a half-close here is local only: it does
+// not propagate to the peer, which is an acceptable simplification for a
+// test double.
+type conn struct {
+	net.Conn
+	mu          sync.Mutex
+	readClosed  bool
+	writeClosed bool
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	closed := c.readClosed
+	c.mu.Unlock()
+	if closed {
+		return 0, io.EOF
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *conn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	closed := c.writeClosed
+	c.mu.Unlock()
+	if closed {
+		return 0, io.ErrClosedPipe
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *conn) CloseRead() error {
+	c.mu.Lock()
+	c.readClosed = true
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *conn) CloseWrite() error {
+	c.mu.Lock()
+	c.writeClosed = true
+	c.mu.Unlock()
+	return nil
+}
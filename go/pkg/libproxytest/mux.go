@@ -0,0 +1,97 @@
+package libproxytest
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/moby/vpnkit/go/pkg/libproxy"
+)
+
+// Mux is an in-memory libproxy.Multiplexer backed by a virtual network of
+// Bridge-linked pipes, standing in for the real vsock/AF_VSOCK multiplexer
+// in tests. Call Backend to register a destination before Dial-ing it.
+type Mux struct {
+	bridge Bridge
+
+	mu       sync.Mutex
+	backends map[destKey]libproxy.Conn
+	accepts  chan accepted
+	closed   bool
+}
+
+type accepted struct {
+	conn libproxy.Conn
+	dest libproxy.Destination
+}
+
+// NewMux returns a Mux whose backends are linked to dialers through bridge.
+func NewMux(bridge Bridge) *Mux {
+	return &Mux{
+		bridge:   bridge,
+		backends: map[destKey]libproxy.Conn{},
+		accepts:  make(chan accepted, 16),
+	}
+}
+
+// Backend registers a virtual backend listening at dest and returns the
+// test-facing end of the pipe: bytes written to it are what a Dial(dest)
+// caller reads, and vice versa.
+func (m *Mux) Backend(dest libproxy.Destination) libproxy.Conn {
+	client, server := m.bridge.pipe()
+	m.mu.Lock()
+	m.backends[keyOf(dest)] = client
+	m.mu.Unlock()
+	return server
+}
+
+// Inject makes conn appear as if the remote had opened a connection destined
+// for dest, to be picked up by a subsequent Accept.
+func (m *Mux) Inject(dest libproxy.Destination, conn libproxy.Conn) {
+	m.accepts <- accepted{conn, dest}
+}
+
+func (m *Mux) Run() {}
+
+func (m *Mux) IsRunning() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return !m.closed
+}
+
+func (m *Mux) Dial(d libproxy.Destination) (libproxy.Conn, error) {
+	m.mu.Lock()
+	conn, ok := m.backends[keyOf(d)]
+	m.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("libproxytest: no backend registered for %v", d)
+	}
+	return conn, nil
+}
+
+func (m *Mux) Accept() (libproxy.Conn, *libproxy.Destination, error) {
+	a, ok := <-m.accepts
+	if !ok {
+		return nil, nil, errors.New("libproxytest: mux closed")
+	}
+	return a.conn, &a.dest, nil
+}
+
+func (m *Mux) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.closed {
+		close(m.accepts)
+		m.closed = true
+	}
+	return nil
+}
+
+type destKey string
+
+func keyOf(d libproxy.Destination) destKey {
+	if d.Proto == libproxy.Unix {
+		return destKey("unix:" + d.Path)
+	}
+	return destKey(fmt.Sprintf("%s:%s:%d", d.Proto, d.IP, d.Port))
+}
@@ -0,0 +1,61 @@
+package libproxytest
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/moby/vpnkit/go/pkg/libproxy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMuxRoundTrip(t *testing.T) {
+	m := NewMux(Bridge{})
+	dest := libproxy.Destination{Proto: libproxy.TCP, Port: 80}
+	backend := m.Backend(dest)
+	defer backend.Close()
+
+	client, err := m.Dial(dest)
+	assert.Nil(t, err)
+	defer client.Close()
+
+	_, err = client.Write([]byte("hello"))
+	assert.Nil(t, err)
+
+	buf := make([]byte, 5)
+	_, err = backend.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(buf))
+}
+
+func TestBridgeDropsOnFullLoss(t *testing.T) {
+	b := Bridge{Loss: 1}
+	a, bb := b.pipe()
+	defer a.Close()
+	defer bb.Close()
+
+	go func() {
+		a.Write([]byte("dropped"))
+		a.Close()
+	}()
+
+	got, err := ioutil.ReadAll(bb)
+	assert.Nil(t, err)
+	assert.Empty(t, got)
+}
+
+func TestConnHalfClose(t *testing.T) {
+	b := Bridge{}
+	a, bb := b.pipe()
+	defer a.Close()
+	defer bb.Close()
+
+	assert.Nil(t, a.CloseWrite())
+	_, err := a.Write([]byte("x"))
+	assert.NotNil(t, err)
+
+	assert.Nil(t, a.CloseRead())
+	buf := make([]byte, 1)
+	n, err := a.Read(buf)
+	assert.Equal(t, 0, n)
+	assert.NotNil(t, err)
+}
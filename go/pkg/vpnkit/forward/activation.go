@@ -0,0 +1,76 @@
+package forward
+
+// Adoption of listener sockets that were opened by a supervisor before
+// vpnkit started, instead of binding them directly with
+// net.ListenTCP/net.ListenUnix. This lets vpnkit run unprivileged while a
+// supervisor holds a low port on its behalf, and lets fds be carried across
+// an exec for a zero-downtime restart.
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// listenerFDs returns the file descriptors inherited from the environment,
+// keyed by name, following systemd's socket activation protocol
+// (LISTEN_PID/LISTEN_FDS/LISTEN_FDNAMES). The first inherited fd is always
+// 3; unnamed fds are keyed by their index as a string.
+func listenerFDs() map[string]int {
+	fds := map[string]int{}
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return fds
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return fds
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for i := 0; i < n; i++ {
+		name := strconv.Itoa(i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		fds[name] = 3 + i
+	}
+	return fds
+}
+
+// inheritedListener adopts the stream socket inherited under name, via
+// systemd's LISTEN_FDS convention or, failing that, launchd's
+// launch_activate_socket.
+func inheritedListener(name string) (net.Listener, error) {
+	if fd, ok := listenerFDs()[name]; ok {
+		f := os.NewFile(uintptr(fd), name)
+		defer f.Close()
+		return net.FileListener(f)
+	}
+	return activateLaunchdSocket(name)
+}
+
+// inheritedPacketConn adopts the datagram socket inherited under name, the
+// UDP equivalent of inheritedListener.
+func inheritedPacketConn(name string) (net.PacketConn, error) {
+	if fd, ok := listenerFDs()[name]; ok {
+		f := os.NewFile(uintptr(fd), name)
+		defer f.Close()
+		return net.FilePacketConn(f)
+	}
+	return activateLaunchdPacketConn(name)
+}
+
+// activateLaunchdSocket and activateLaunchdPacketConn are overridden on
+// darwin to adopt a stream/datagram socket handed out by launchd. Elsewhere
+// an inherited socket can only come from systemd. They're separate because
+// net.FileListener rejects a SOCK_DGRAM fd, so the two cases can't share a
+// net.Listener-returning signature.
+var activateLaunchdSocket = func(name string) (net.Listener, error) {
+	return nil, errors.New("no inherited socket named " + name)
+}
+
+var activateLaunchdPacketConn = func(name string) (net.PacketConn, error) {
+	return nil, errors.New("no inherited socket named " + name)
+}
@@ -0,0 +1,65 @@
+// +build darwin
+
+package forward
+
+/*
+#include <launch.h>
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+func init() {
+	activateLaunchdSocket = launchdListener
+	activateLaunchdPacketConn = launchdPacketConn
+}
+
+// launchActivateSocket adopts the first fd launchd hands back for name,
+// which must match a key in the Sockets dictionary of this job's
+// launchd.plist.
+func launchActivateSocket(name string) (*os.File, error) {
+	cName := C.CString(name)
+	defer C.free(unsafe.Pointer(cName))
+
+	var fds *C.int
+	var n C.size_t
+	if rc := C.launch_activate_socket(cName, &fds, &n); rc != 0 {
+		return nil, errors.Wrapf(syscall.Errno(rc), "launch_activate_socket(%s)", name)
+	}
+	defer C.free(unsafe.Pointer(fds))
+	if n == 0 {
+		return nil, errors.New("launchd returned no sockets for " + name)
+	}
+	fdSlice := (*[1 << 10]C.int)(unsafe.Pointer(fds))[:n:n]
+	return os.NewFile(uintptr(fdSlice[0]), name), nil
+}
+
+// launchdListener adopts a stream socket handed out by launchd.
+func launchdListener(name string) (net.Listener, error) {
+	f, err := launchActivateSocket(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// launchdPacketConn adopts a datagram socket handed out by launchd.
+// net.FileListener rejects SOCK_DGRAM fds, so UDP needs its own path
+// through net.FilePacketConn rather than going through launchdListener.
+func launchdPacketConn(name string) (net.PacketConn, error) {
+	f, err := launchActivateSocket(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return net.FilePacketConn(f)
+}
@@ -0,0 +1,50 @@
+package forward
+
+import (
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/moby/vpnkit/go/pkg/vpnkit"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListenerFDsWrongPID(t *testing.T) {
+	os.Setenv("LISTEN_PID", "1")
+	os.Setenv("LISTEN_FDS", "1")
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+
+	assert.Empty(t, listenerFDs())
+}
+
+func TestListenerFDsNamed(t *testing.T) {
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDS", "2")
+	os.Setenv("LISTEN_FDNAMES", "http:")
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	fds := listenerFDs()
+	assert.Equal(t, 3, fds["http"])
+	assert.Equal(t, 4, fds["1"])
+}
+
+func TestInheritedListenerUnknownName(t *testing.T) {
+	_, err := inheritedListener("no-such-socket")
+	assert.NotNil(t, err)
+}
+
+func TestInheritedPacketConnUnknownName(t *testing.T) {
+	_, err := inheritedPacketConn("no-such-socket")
+	assert.NotNil(t, err)
+}
+
+func TestTCPNetworkListenWithoutInheritFD(t *testing.T) {
+	outPort, _ := findFreeLocalTCPPorts(t)
+	n := &tcpNetwork{}
+	l, err := n.listen(vpnkit.Port{OutIP: localhost, OutPort: outPort})
+	assert.Nil(t, err)
+	defer l.close()
+}
@@ -6,7 +6,6 @@ import (
 	"errors"
 	"log"
 
-	"github.com/moby/vpnkit/go/pkg/libproxy"
 	"github.com/moby/vpnkit/go/pkg/vpnkit"
 )
 
@@ -17,39 +16,49 @@ type Forward interface {
 	Port() vpnkit.Port // Port describes the forwards
 }
 
+// Make constructs a Forward from a port description. A port naming a
+// contiguous OutPort..OutPortEnd range is expanded into one Forward per
+// out/in port pair, bound under a single Forward handle; a plain port
+// forwards to a single destination, or round-robins/randomizes/least-conns
+// across port.Destinations when more than one is given.
 func Make(ctrl vpnkit.Control, port vpnkit.Port) (Forward, error) {
-	log.Printf("Adding %s", port.String())
-	dest := &libproxy.Destination{
-		IP:   port.InIP,
-		Port: port.InPort,
-		Path: port.InPath,
+	if port.OutPortEnd > port.OutPort {
+		return makeRange(ctrl, port)
 	}
+	log.Printf("Adding %s", port.String())
 	quit := make(chan struct{})
+	picker, err := newPicker(port, quit)
+	if err != nil {
+		return nil, err
+	}
 	common := common{
 		ctrl,
 		port,
-		dest,
+		picker,
 		quit,
 	}
 	switch port.Proto {
 	case vpnkit.TCP:
-		dest.Proto = libproxy.TCP
+		if port.Mode == vpnkit.TProxy {
+			return makeTCPTProxy(common)
+		}
 		return makeTCP(common)
 	case vpnkit.UDP:
-		dest.Proto = libproxy.UDP
+		if port.Mode == vpnkit.TProxy {
+			return makeUDPTProxy(common)
+		}
 		return makeUDP(common)
 	case vpnkit.Unix:
-		dest.Proto = libproxy.Unix
 		return makeUnix(common)
 	}
 	return nil, errors.New("cannot listen on unknown protocol " + string(port.Proto))
 }
 
 type common struct {
-	ctrl vpnkit.Control
-	port vpnkit.Port
-	dest *libproxy.Destination
-	quit chan struct{}
+	ctrl   vpnkit.Control
+	port   vpnkit.Port
+	picker picker
+	quit   chan struct{}
 }
 
 func (c *common) Port() vpnkit.Port {
@@ -1,12 +1,16 @@
 package forward
 
 import (
+	"io"
 	"net"
 	"os"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/moby/vpnkit/go/pkg/libproxy"
+	"github.com/moby/vpnkit/go/pkg/libproxytest"
 	"github.com/moby/vpnkit/go/pkg/vpnkit"
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
@@ -84,7 +88,9 @@ func findFreeLocalUDPPorts(t *testing.T) (uint16, uint16) {
 
 var localhost = net.ParseIP("127.0.0.1")
 
-func TestTCP(t *testing.T) {
+// makeTCPForward creates a plain TCP forward with no mux set, for tests
+// that only care about the listener lifecycle, not what's dialed.
+func makeTCPForward(t *testing.T) Forward {
 	ctrl := &mockControl{}
 	outPort, inPort := findFreeLocalTCPPorts(t)
 	port := vpnkit.Port{
@@ -96,7 +102,11 @@ func TestTCP(t *testing.T) {
 	}
 	f, err := Make(ctrl, port)
 	assert.Nil(t, err)
-	f.Stop()
+	return f
+}
+
+func TestTCP(t *testing.T) {
+	makeTCPForward(t).Stop()
 }
 
 func TestTCPLeak(t *testing.T) {
@@ -119,7 +129,7 @@ func TestUDP(t *testing.T) {
 	}
 	f, err := Make(ctrl, port)
 	assert.Nil(t, err)
-	f.Run()
+	go f.Run()
 	f.Stop()
 }
 
@@ -194,3 +204,263 @@ func TestInterfaceDoesNotExist(t *testing.T) {
 	}
 	assert.Nil(t, f)
 }
+
+// The tests below use libproxytest's in-memory Mux to actually round-trip
+// bytes through a Forward end-to-end, rather than just observing that Dial
+// was called.
+
+func TestTCPRoundTrip(t *testing.T) {
+	outPort, inPort := findFreeLocalTCPPorts(t)
+	port := vpnkit.Port{
+		OutIP:   localhost,
+		OutPort: outPort,
+		InIP:    localhost,
+		InPort:  inPort,
+		Proto:   vpnkit.TCP,
+	}
+
+	mux := libproxytest.NewMux(libproxytest.Bridge{})
+	backend := mux.Backend(libproxy.Destination{Proto: libproxy.TCP, IP: localhost, Port: inPort})
+	defer backend.Close()
+
+	ctrl := &mockControl{}
+	ctrl.SetMux(mux)
+	f, err := Make(ctrl, port)
+	assert.Nil(t, err)
+	go f.Run()
+	defer f.Stop()
+
+	client, err := net.Dial("tcp", net.JoinHostPort(localhost.String(), strconv.Itoa(int(outPort))))
+	assert.Nil(t, err)
+	defer client.Close()
+
+	_, err = client.Write([]byte("ping"))
+	assert.Nil(t, err)
+	got := make([]byte, 4)
+	_, err = io.ReadFull(backend, got)
+	assert.Nil(t, err)
+	assert.Equal(t, "ping", string(got))
+
+	_, err = backend.Write([]byte("pong"))
+	assert.Nil(t, err)
+	reply := make([]byte, 4)
+	_, err = io.ReadFull(client, reply)
+	assert.Nil(t, err)
+	assert.Equal(t, "pong", string(reply))
+}
+
+// TestStreamSurvivesDialFailure checks that a client routed to a down
+// destination doesn't wedge the listener for every client after it: the
+// accept loop must keep reading instead of returning on the first Dial
+// error, or multi-destination failover degrades to a single-shot listener.
+func TestStreamSurvivesDialFailure(t *testing.T) {
+	outPort, _ := findFreeLocalTCPPorts(t)
+	downPort := uint16(10000)
+	upPort := uint16(10001)
+	port := vpnkit.Port{
+		OutIP:        localhost,
+		OutPort:      outPort,
+		Proto:        vpnkit.TCP,
+		Destinations: []vpnkit.Destination{{IP: localhost, Port: downPort}, {IP: localhost, Port: upPort}},
+	}
+
+	mux := libproxytest.NewMux(libproxytest.Bridge{})
+	backend := mux.Backend(libproxy.Destination{Proto: libproxy.TCP, IP: localhost, Port: upPort})
+	defer backend.Close()
+
+	ctrl := &mockControl{}
+	ctrl.SetMux(mux)
+	f, err := Make(ctrl, port)
+	assert.Nil(t, err)
+	go f.Run()
+	defer f.Stop()
+
+	addr := net.JoinHostPort(localhost.String(), strconv.Itoa(int(outPort)))
+
+	// First client is round-robined to the down destination: Dial fails,
+	// and the connection should simply be closed rather than killing Run.
+	failed, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer failed.Close()
+	buf := make([]byte, 1)
+	failed.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = failed.Read(buf)
+	assert.NotNil(t, err)
+
+	// The listener must still be accepting: the next client lands on the
+	// up destination and round-trips normally.
+	client, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer client.Close()
+
+	_, err = client.Write([]byte("ping"))
+	assert.Nil(t, err)
+	got := make([]byte, 4)
+	_, err = io.ReadFull(backend, got)
+	assert.Nil(t, err)
+	assert.Equal(t, "ping", string(got))
+}
+
+func TestUDPRoundTrip(t *testing.T) {
+	outPort, inPort := findFreeLocalUDPPorts(t)
+	port := vpnkit.Port{
+		OutIP:   localhost,
+		OutPort: outPort,
+		InIP:    localhost,
+		InPort:  inPort,
+		Proto:   vpnkit.UDP,
+	}
+
+	mux := libproxytest.NewMux(libproxytest.Bridge{})
+	backend := mux.Backend(libproxy.Destination{Proto: libproxy.UDP, IP: localhost, Port: inPort})
+	defer backend.Close()
+
+	ctrl := &mockControl{}
+	ctrl.SetMux(mux)
+	f, err := Make(ctrl, port)
+	assert.Nil(t, err)
+	go f.Run()
+	defer f.Stop()
+
+	client, err := net.Dial("udp", net.JoinHostPort(localhost.String(), strconv.Itoa(int(outPort))))
+	assert.Nil(t, err)
+	defer client.Close()
+
+	_, err = client.Write([]byte("ping"))
+	assert.Nil(t, err)
+	got := make([]byte, 4)
+	_, err = io.ReadFull(backend, got)
+	assert.Nil(t, err)
+	assert.Equal(t, "ping", string(got))
+
+	_, err = backend.Write([]byte("pong"))
+	assert.Nil(t, err)
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply := make([]byte, 4)
+	_, err = io.ReadFull(client, reply)
+	assert.Nil(t, err)
+	assert.Equal(t, "pong", string(reply))
+}
+
+func TestUnixRoundTrip(t *testing.T) {
+	outPath := "/tmp/outpath-roundtrip.sock"
+	inPath := "/tmp/inpath-roundtrip.sock"
+	if err := os.Remove(outPath); err != nil {
+		assert.Equal(t, true, os.IsNotExist(err))
+	}
+	port := vpnkit.Port{
+		OutPath: outPath,
+		InPath:  inPath,
+		Proto:   vpnkit.Unix,
+	}
+
+	mux := libproxytest.NewMux(libproxytest.Bridge{})
+	backend := mux.Backend(libproxy.Destination{Proto: libproxy.Unix, Path: inPath})
+	defer backend.Close()
+
+	ctrl := &mockControl{}
+	ctrl.SetMux(mux)
+	f, err := Make(ctrl, port)
+	assert.Nil(t, err)
+	go f.Run()
+	defer f.Stop()
+
+	client, err := net.Dial("unix", outPath)
+	assert.Nil(t, err)
+	defer client.Close()
+
+	_, err = client.Write([]byte("ping"))
+	assert.Nil(t, err)
+	got := make([]byte, 4)
+	_, err = io.ReadFull(backend, got)
+	assert.Nil(t, err)
+	assert.Equal(t, "ping", string(got))
+}
+
+func TestTCPHalfClose(t *testing.T) {
+	outPort, inPort := findFreeLocalTCPPorts(t)
+	port := vpnkit.Port{
+		OutIP:   localhost,
+		OutPort: outPort,
+		InIP:    localhost,
+		InPort:  inPort,
+		Proto:   vpnkit.TCP,
+	}
+
+	mux := libproxytest.NewMux(libproxytest.Bridge{})
+	backend := mux.Backend(libproxy.Destination{Proto: libproxy.TCP, IP: localhost, Port: inPort})
+	defer backend.Close()
+
+	ctrl := &mockControl{}
+	ctrl.SetMux(mux)
+	f, err := Make(ctrl, port)
+	assert.Nil(t, err)
+	go f.Run()
+	defer f.Stop()
+
+	client, err := net.Dial("tcp", net.JoinHostPort(localhost.String(), strconv.Itoa(int(outPort))))
+	assert.Nil(t, err)
+	defer client.Close()
+
+	_, err = client.Write([]byte("ping"))
+	assert.Nil(t, err)
+	got := make([]byte, 4)
+	_, err = io.ReadFull(backend, got)
+	assert.Nil(t, err)
+	assert.Equal(t, "ping", string(got))
+
+	// A half-closed client (no more writes coming) must still be able to
+	// read a reply: CloseWrite must not tear down the whole connection.
+	assert.Nil(t, client.(*net.TCPConn).CloseWrite())
+
+	_, err = backend.Write([]byte("pong"))
+	assert.Nil(t, err)
+	reply := make([]byte, 4)
+	_, err = io.ReadFull(client, reply)
+	assert.Nil(t, err)
+	assert.Equal(t, "pong", string(reply))
+}
+
+// TestUDPSessionIdleTimeout exercises udpClientSession's idle bookkeeping
+// directly rather than waiting out a real udpSessionIdleTimeout: a session
+// last active two timeouts ago reads as idle, and touch() resets the clock
+// that reapIdleSessions reads to decide whether a session has gone quiet.
+func TestUDPSessionIdleTimeout(t *testing.T) {
+	s := &udpClientSession{lastActive: time.Now().Add(-2 * udpSessionIdleTimeout)}
+	assert.True(t, s.idleSince() >= udpSessionIdleTimeout)
+
+	s.touch()
+	assert.True(t, s.idleSince() < udpSessionIdleTimeout)
+}
+
+func TestTeardownClosesClient(t *testing.T) {
+	outPort, inPort := findFreeLocalTCPPorts(t)
+	port := vpnkit.Port{
+		OutIP:   localhost,
+		OutPort: outPort,
+		InIP:    localhost,
+		InPort:  inPort,
+		Proto:   vpnkit.TCP,
+	}
+
+	mux := libproxytest.NewMux(libproxytest.Bridge{})
+	backend := mux.Backend(libproxy.Destination{Proto: libproxy.TCP, IP: localhost, Port: inPort})
+	defer backend.Close()
+
+	ctrl := &mockControl{}
+	ctrl.SetMux(mux)
+	f, err := Make(ctrl, port)
+	assert.Nil(t, err)
+	go f.Run()
+
+	client, err := net.Dial("tcp", net.JoinHostPort(localhost.String(), strconv.Itoa(int(outPort))))
+	assert.Nil(t, err)
+	defer client.Close()
+
+	f.Stop()
+
+	buf := make([]byte, 1)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = client.Read(buf)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,141 @@
+package forward
+
+// Active and passive health checking for multi-destination forwards. A down
+// backend is skipped by the picker, rather than failing every new connection
+// routed to it, and is re-probed on its check interval when
+// port.HealthCheck.Interval is set; without an interval it comes back only
+// through a successful Dial, which happens once every destination is down
+// and the picker falls back to it. This turns Forward
+// from a dumb 1:1 pipe into a small L4 load balancer.
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/moby/vpnkit/go/pkg/libproxy"
+	"github.com/moby/vpnkit/go/pkg/vpnkit"
+)
+
+// healthTracker records whether each destination of a multi-destination
+// forward is currently healthy. A destination starts healthy; consecutive
+// mux.Dial failures (passive checking, fed by Observe) and a failing active
+// probe, if port.HealthCheck.Interval is set, both count towards the same
+// UnhealthyThreshold.
+type healthTracker struct {
+	cfg vpnkit.HealthCheck
+
+	mu    sync.Mutex
+	state map[string]*health
+}
+
+type health struct {
+	up       bool
+	failures int
+}
+
+// newHealthTracker starts an active probe goroutine per destination, if
+// configured, each of which exits when quit is closed.
+func newHealthTracker(cfg vpnkit.HealthCheck, dests []libproxy.Destination, quit chan struct{}) *healthTracker {
+	state := make(map[string]*health, len(dests))
+	for _, d := range dests {
+		state[destKey(d)] = &health{up: true}
+	}
+	h := &healthTracker{cfg: cfg, state: state}
+	if cfg.Interval > 0 {
+		for _, d := range dests {
+			go h.probeLoop(d, quit)
+		}
+	}
+	return h
+}
+
+// IsUp reports whether d should currently be considered for new connections.
+// A Destination with no recorded state (it isn't one of this tracker's
+// configured destinations) is treated as up, the same fail-safe default
+// RecordDialResult uses.
+func (h *healthTracker) IsUp(d libproxy.Destination) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.state[destKey(d)]
+	if !ok {
+		return true
+	}
+	return s.up
+}
+
+// RecordDialResult is passive health checking: err from the most recent
+// mux.Dial to d marks it down after UnhealthyThreshold consecutive failures,
+// and a success brings it straight back up.
+func (h *healthTracker) RecordDialResult(d libproxy.Destination, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.state[destKey(d)]
+	if !ok {
+		return
+	}
+	if err == nil {
+		s.failures = 0
+		s.up = true
+		return
+	}
+	s.failures++
+	if s.failures >= h.threshold() {
+		s.up = false
+	}
+}
+
+func (h *healthTracker) threshold() int {
+	if h.cfg.UnhealthyThreshold > 0 {
+		return h.cfg.UnhealthyThreshold
+	}
+	return 1
+}
+
+func (h *healthTracker) probeLoop(d libproxy.Destination, quit chan struct{}) {
+	t := time.NewTicker(h.cfg.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-t.C:
+			h.RecordDialResult(d, probe(d, h.cfg))
+		}
+	}
+}
+
+// probe runs the configured check against d: an HTTP GET if HTTPPath is set,
+// otherwise a plain TCP connect.
+func probe(d libproxy.Destination, cfg vpnkit.HealthCheck) error {
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+	addr := net.JoinHostPort(d.IP.String(), strconv.Itoa(int(d.Port)))
+	if cfg.HTTPPath != "" {
+		client := http.Client{Timeout: timeout}
+		resp, err := client.Get("http://" + addr + cfg.HTTPPath)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			return errHealthCheckStatus(resp.StatusCode)
+		}
+		return nil
+	}
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+type errHealthCheckStatus int
+
+func (e errHealthCheckStatus) Error() string {
+	return "health check returned HTTP " + strconv.Itoa(int(e))
+}
@@ -0,0 +1,43 @@
+package forward
+
+import (
+	"testing"
+
+	"github.com/moby/vpnkit/go/pkg/libproxy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthTrackerMarksDownAfterThreshold(t *testing.T) {
+	d := libproxy.Destination{Proto: libproxy.TCP, IP: localhost, Port: 10000}
+	h := &healthTracker{state: map[string]*health{destKey(d): {up: true}}}
+	h.cfg.UnhealthyThreshold = 2
+
+	assert.True(t, h.IsUp(d))
+	h.RecordDialResult(d, errDial)
+	assert.True(t, h.IsUp(d))
+	h.RecordDialResult(d, errDial)
+	assert.False(t, h.IsUp(d))
+
+	h.RecordDialResult(d, nil)
+	assert.True(t, h.IsUp(d))
+}
+
+func TestLeastConnPickerSkipsDownDestination(t *testing.T) {
+	down := libproxy.Destination{Proto: libproxy.TCP, IP: localhost, Port: 10000}
+	up := libproxy.Destination{Proto: libproxy.TCP, IP: localhost, Port: 10001}
+	health := &healthTracker{state: map[string]*health{
+		destKey(down): {up: false},
+		destKey(up):   {up: true},
+	}}
+	p := &leastConnPicker{dests: []libproxy.Destination{down, up}, conns: make([]int, 2), health: health}
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, up, p.Pick())
+	}
+}
+
+type dialError string
+
+func (e dialError) Error() string { return string(e) }
+
+var errDial = dialError("dial failed")
@@ -0,0 +1,212 @@
+package forward
+
+// Destination selection for forwards that publish more than one upstream
+// target under a single Port.
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+
+	"github.com/moby/vpnkit/go/pkg/libproxy"
+	"github.com/moby/vpnkit/go/pkg/vpnkit"
+)
+
+// destKey returns a comparable key for a Destination. libproxy.Destination
+// embeds a net.IP ([]byte), so it can't be compared with == or used as a map
+// key directly.
+func destKey(d libproxy.Destination) string {
+	if d.Proto == libproxy.Unix {
+		return "unix:" + d.Path
+	}
+	ip := ""
+	if d.IP != nil {
+		ip = d.IP.String()
+	}
+	return fmt.Sprintf("%s:%s:%d", d.Proto, ip, d.Port)
+}
+
+// picker chooses the upstream Destination a new connection should be dialed
+// against. A plain 1:1 forward always picks the same Destination; a forward
+// with multiple Destinations picks between them according to port.Policy.
+type picker interface {
+	Pick() libproxy.Destination
+}
+
+// newPicker builds the picker described by port. With no Destinations it
+// falls back to the single InIP:InPort/InPath target used by a plain
+// forward. quit, shared with the rest of the forward, shuts down any active
+// health-check goroutines when the forward is Stopped.
+func newPicker(port vpnkit.Port, quit chan struct{}) (picker, error) {
+	proto := protoOf(port.Proto)
+	if len(port.Destinations) == 0 {
+		return &fixedPicker{libproxy.Destination{
+			Proto: proto,
+			IP:    port.InIP,
+			Port:  port.InPort,
+			Path:  port.InPath,
+		}}, nil
+	}
+	dests := make([]libproxy.Destination, len(port.Destinations))
+	for i, d := range port.Destinations {
+		dests[i] = libproxy.Destination{
+			Proto: proto,
+			IP:    d.IP,
+			Port:  d.Port,
+		}
+	}
+	health := newHealthTracker(port.HealthCheck, dests, quit)
+	switch port.Policy {
+	case "", vpnkit.RoundRobin:
+		return &roundRobinPicker{dests: dests, health: health}, nil
+	case vpnkit.Random:
+		return &randomPicker{dests: dests, health: health}, nil
+	case vpnkit.LeastConn:
+		return &leastConnPicker{dests: dests, conns: make([]int, len(dests)), health: health}, nil
+	}
+	return nil, errUnknownPolicy(port.Policy)
+}
+
+func protoOf(p vpnkit.Protocol) libproxy.Proto {
+	switch p {
+	case vpnkit.TCP:
+		return libproxy.TCP
+	case vpnkit.UDP:
+		return libproxy.UDP
+	default:
+		return libproxy.Unix
+	}
+}
+
+type fixedPicker struct {
+	dest libproxy.Destination
+}
+
+func (p *fixedPicker) Pick() libproxy.Destination {
+	return p.dest
+}
+
+type roundRobinPicker struct {
+	mu     sync.Mutex
+	dests  []libproxy.Destination
+	next   int
+	health *healthTracker
+}
+
+// Pick returns the next destination in rotation that health considers up,
+// or the plain next one if every destination is currently down.
+func (p *roundRobinPicker) Pick() libproxy.Destination {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	idx := p.next % len(p.dests)
+	for i := 0; i < len(p.dests); i++ {
+		candidate := (p.next + i) % len(p.dests)
+		if p.health.IsUp(p.dests[candidate]) {
+			idx = candidate
+			break
+		}
+	}
+	p.next = idx + 1
+	return p.dests[idx]
+}
+
+func (p *roundRobinPicker) Observe(d libproxy.Destination, err error) {
+	p.health.RecordDialResult(d, err)
+}
+
+type randomPicker struct {
+	dests  []libproxy.Destination
+	health *healthTracker
+}
+
+func (p *randomPicker) Pick() libproxy.Destination {
+	candidates := p.healthyDests()
+	return candidates[rand.Intn(len(candidates))]
+}
+
+func (p *randomPicker) healthyDests() []libproxy.Destination {
+	var up []libproxy.Destination
+	for _, d := range p.dests {
+		if p.health.IsUp(d) {
+			up = append(up, d)
+		}
+	}
+	if len(up) == 0 {
+		return p.dests
+	}
+	return up
+}
+
+func (p *randomPicker) Observe(d libproxy.Destination, err error) {
+	p.health.RecordDialResult(d, err)
+}
+
+// leastConnPicker sends each new connection to the healthy destination with
+// the fewest connections currently proxied through it. Callers must call
+// Release once a connection dialed via Pick has finished.
+type leastConnPicker struct {
+	mu     sync.Mutex
+	dests  []libproxy.Destination
+	conns  []int
+	health *healthTracker
+}
+
+func (p *leastConnPicker) Pick() libproxy.Destination {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	best := -1
+	for i := range p.dests {
+		if !p.health.IsUp(p.dests[i]) {
+			continue
+		}
+		if best == -1 || p.conns[i] < p.conns[best] {
+			best = i
+		}
+	}
+	if best == -1 {
+		// every destination is down: fall back to plain least-conn so the
+		// forward still attempts a connection rather than stalling.
+		best = 0
+		for i := range p.conns {
+			if p.conns[i] < p.conns[best] {
+				best = i
+			}
+		}
+	}
+	p.conns[best]++
+	return p.dests[best]
+}
+
+func (p *leastConnPicker) Release(d libproxy.Destination) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := destKey(d)
+	for i, dest := range p.dests {
+		if destKey(dest) == key {
+			p.conns[i]--
+			return
+		}
+	}
+}
+
+func (p *leastConnPicker) Observe(d libproxy.Destination, err error) {
+	p.health.RecordDialResult(d, err)
+}
+
+// releaser is implemented by pickers which need to know when a connection
+// dialed via Pick has finished, e.g. to keep a least-connections count.
+type releaser interface {
+	Release(libproxy.Destination)
+}
+
+// dialObserver is implemented by pickers that feed mux.Dial results back
+// into passive health checking.
+type dialObserver interface {
+	Observe(libproxy.Destination, error)
+}
+
+type errUnknownPolicy string
+
+func (e errUnknownPolicy) Error() string {
+	return "unknown forward policy " + string(e)
+}
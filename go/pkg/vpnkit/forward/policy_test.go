@@ -0,0 +1,53 @@
+package forward
+
+import (
+	"testing"
+
+	"github.com/moby/vpnkit/go/pkg/libproxy"
+	"github.com/moby/vpnkit/go/pkg/vpnkit"
+	"github.com/stretchr/testify/assert"
+)
+
+func destinations(n int) []vpnkit.Destination {
+	dests := make([]vpnkit.Destination, n)
+	for i := range dests {
+		dests[i] = vpnkit.Destination{IP: localhost, Port: uint16(10000 + i)}
+	}
+	return dests
+}
+
+func TestNewPickerSingleDestination(t *testing.T) {
+	port := vpnkit.Port{Proto: vpnkit.TCP, InIP: localhost, InPort: 80}
+	p, err := newPicker(port, make(chan struct{}))
+	assert.Nil(t, err)
+	assert.Equal(t, libproxy.Destination{Proto: libproxy.TCP, IP: localhost, Port: 80}, p.Pick())
+}
+
+func TestRoundRobinPicker(t *testing.T) {
+	port := vpnkit.Port{Proto: vpnkit.TCP, Destinations: destinations(3)}
+	p, err := newPicker(port, make(chan struct{}))
+	assert.Nil(t, err)
+	for i := 0; i < 6; i++ {
+		assert.Equal(t, uint16(10000+i%3), p.Pick().Port)
+	}
+}
+
+func TestLeastConnPicker(t *testing.T) {
+	port := vpnkit.Port{Proto: vpnkit.TCP, Policy: vpnkit.LeastConn, Destinations: destinations(2)}
+	p, err := newPicker(port, make(chan struct{}))
+	assert.Nil(t, err)
+
+	first := p.Pick()
+	second := p.Pick()
+	assert.NotEqual(t, first.Port, second.Port)
+
+	p.(*leastConnPicker).Release(first)
+	third := p.Pick()
+	assert.Equal(t, first.Port, third.Port)
+}
+
+func TestNewPickerUnknownPolicy(t *testing.T) {
+	port := vpnkit.Port{Proto: vpnkit.TCP, Policy: "bogus", Destinations: destinations(2)}
+	_, err := newPicker(port, make(chan struct{}))
+	assert.NotNil(t, err)
+}
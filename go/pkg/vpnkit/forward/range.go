@@ -0,0 +1,69 @@
+package forward
+
+// Expansion of a single Port describing a contiguous OutPort..OutPortEnd
+// range into one worker Forward per port pair.
+
+import (
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/moby/vpnkit/go/pkg/vpnkit"
+)
+
+// makeRange expands port.OutPort..port.OutPortEnd into individual 1:1
+// forwards, each bound to the matching offset in port.InPort, and returns
+// them wrapped as a single Forward. If InPortEnd is set it must span exactly
+// as many ports as OutPort..OutPortEnd, so every out port has an unambiguous
+// in port to map to.
+func makeRange(ctrl vpnkit.Control, port vpnkit.Port) (Forward, error) {
+	n := int(port.OutPortEnd) - int(port.OutPort)
+	if port.InPortEnd != 0 && int(port.InPortEnd)-int(port.InPort) != n {
+		return nil, errors.New("OutPortEnd and InPortEnd must span the same number of ports")
+	}
+	workers := make([]Forward, 0, n+1)
+	for i := 0; i <= n; i++ {
+		single := port
+		single.OutPort = port.OutPort + uint16(i)
+		single.InPort = port.InPort + uint16(i)
+		single.OutPortEnd = 0
+		single.InPortEnd = 0
+		f, err := Make(ctrl, single)
+		if err != nil {
+			for _, w := range workers {
+				w.Stop()
+			}
+			return nil, err
+		}
+		workers = append(workers, f)
+	}
+	return &rangeForward{port, workers}, nil
+}
+
+type rangeForward struct {
+	port    vpnkit.Port
+	workers []Forward
+}
+
+func (r *rangeForward) Run() {
+	var wg sync.WaitGroup
+	for _, w := range r.workers {
+		wg.Add(1)
+		go func(w Forward) {
+			defer wg.Done()
+			w.Run()
+		}(w)
+	}
+	wg.Wait()
+}
+
+func (r *rangeForward) Stop() {
+	log.Printf("Removing %s", r.port.String())
+	for _, w := range r.workers {
+		w.Stop()
+	}
+}
+
+func (r *rangeForward) Port() vpnkit.Port {
+	return r.port
+}
@@ -0,0 +1,43 @@
+package forward
+
+import (
+	"testing"
+
+	"github.com/moby/vpnkit/go/pkg/vpnkit"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMakeRangeExpandsPorts(t *testing.T) {
+	outStart, inStart := findFreeLocalTCPPorts(t)
+	port := vpnkit.Port{
+		OutIP:      localhost,
+		OutPort:    outStart,
+		OutPortEnd: outStart + 2,
+		InIP:       localhost,
+		InPort:     inStart,
+		Proto:      vpnkit.TCP,
+	}
+	f, err := Make(&mockControl{}, port)
+	assert.Nil(t, err)
+	defer f.Stop()
+
+	r, ok := f.(*rangeForward)
+	assert.True(t, ok)
+	assert.Len(t, r.workers, 3)
+}
+
+func TestMakeRangeMismatchedWidthIsRejected(t *testing.T) {
+	outStart, inStart := findFreeLocalTCPPorts(t)
+	port := vpnkit.Port{
+		OutIP:      localhost,
+		OutPort:    outStart,
+		OutPortEnd: outStart + 2,
+		InIP:       localhost,
+		InPort:     inStart,
+		InPortEnd:  inStart + 1,
+		Proto:      vpnkit.TCP,
+	}
+	f, err := Make(&mockControl{}, port)
+	assert.NotNil(t, err)
+	assert.Nil(t, f)
+}
@@ -18,6 +18,13 @@ type listener interface {
 	close() error
 }
 
+// connDestination is implemented by Conns that carry their own upstream
+// destination, e.g. a tproxy connection's original destination, overriding
+// the forward's picker.
+type connDestination interface {
+	destination() libproxy.Destination
+}
+
 func makeStream(c common, n network) (*stream, error) {
 	l, err := n.listen(c.port)
 	if err != nil {
@@ -43,13 +50,25 @@ func (s *stream) Run() {
 			return
 		}
 		mux := s.ctrl.Mux()
-		dest, err := mux.Dial(*s.dest)
+		var target libproxy.Destination
+		if cd, ok := src.(connDestination); ok {
+			target = cd.destination()
+		} else {
+			target = s.picker.Pick()
+		}
+		dest, err := mux.Dial(target)
+		if obs, ok := s.picker.(dialObserver); ok {
+			obs.Observe(target, err)
+		}
 		if err != nil {
 			log.Printf("unable to connect on %s: %s", s.port.String(), err)
 			if err := src.Close(); err != nil {
 				log.Printf("unable to Close on %s: %s", s.port.String(), err)
 			}
-			return
+			if r, ok := s.picker.(releaser); ok {
+				r.Release(target)
+			}
+			continue
 		}
 		go func() {
 			if err := libproxy.ProxyStream(src, dest, s.quit); err != nil {
@@ -58,6 +77,9 @@ func (s *stream) Run() {
 			if err := src.Close(); err != nil {
 				log.Printf("unable to Close on %s: %s", s.port.String(), err)
 			}
+			if r, ok := s.picker.(releaser); ok {
+				r.Release(target)
+			}
 		}()
 
 	}
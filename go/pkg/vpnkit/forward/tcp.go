@@ -0,0 +1,50 @@
+package forward
+
+// Listen on a TCP socket and forward to a remote multiplexer. Works the
+// same on every platform net.ListenTCP supports, so unlike the Unix-domain
+// listener this isn't split into a _unix.go/_windows.go pair.
+
+import (
+	"net"
+
+	"github.com/moby/vpnkit/go/pkg/libproxy"
+	"github.com/moby/vpnkit/go/pkg/vpnkit"
+	"github.com/pkg/errors"
+)
+
+type tcpNetwork struct{}
+
+func (t *tcpNetwork) listen(port vpnkit.Port) (listener, error) {
+	if port.InheritFD != "" {
+		l, err := inheritedListener(port.InheritFD)
+		if err != nil {
+			return nil, err
+		}
+		tl, ok := l.(*net.TCPListener)
+		if !ok {
+			return nil, errors.New("inherited fd " + port.InheritFD + " is not a TCP socket")
+		}
+		return &tcpListener{tl}, nil
+	}
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: port.OutIP, Port: int(port.OutPort)})
+	if err != nil {
+		return nil, err
+	}
+	return &tcpListener{l}, nil
+}
+
+type tcpListener struct {
+	l *net.TCPListener
+}
+
+func (l *tcpListener) accept() (libproxy.Conn, error) {
+	return l.l.AcceptTCP()
+}
+
+func (l *tcpListener) close() error {
+	return l.l.Close()
+}
+
+func makeTCP(c common) (Forward, error) {
+	return makeStream(c, &tcpNetwork{})
+}
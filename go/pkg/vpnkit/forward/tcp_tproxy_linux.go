@@ -0,0 +1,104 @@
+// +build linux
+
+package forward
+
+// A Linux-only TCP listener that binds with IP_TRANSPARENT, allowing it to
+// accept connections addressed to any IP in a routed subnet rather than
+// just port.OutIP, and recovers the connection's original destination from
+// SO_ORIGINAL_DST so it can be forwarded on instead of the fixed
+// port.InIP/InPort.
+//
+// IPv4 only: the IPV6_TRANSPARENT/IPV6_RECVORIGDSTADDR equivalents for
+// routed IPv6 subnets aren't implemented yet. port.OutIP is assumed to be
+// an IPv4 address; a listener and SO_ORIGINAL_DST read against an IPv6
+// socket will behave incorrectly.
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"syscall"
+
+	"github.com/moby/vpnkit/go/pkg/libproxy"
+	"github.com/moby/vpnkit/go/pkg/vpnkit"
+)
+
+// soOriginalDst is SO_ORIGINAL_DST from <linux/netfilter_ipv4.h>.
+const soOriginalDst = 80
+
+type tproxyTCPNetwork struct{}
+
+func (t *tproxyTCPNetwork) listen(port vpnkit.Port) (listener, error) {
+	lc := net.ListenConfig{
+		Control: func(_, _ string, c syscall.RawConn) error {
+			var serr error
+			if err := c.Control(func(fd uintptr) {
+				serr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+			}); err != nil {
+				return err
+			}
+			return serr
+		},
+	}
+	addr := net.JoinHostPort(port.OutIP.String(), strconv.Itoa(int(port.OutPort)))
+	l, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &tproxyTCPListener{l.(*net.TCPListener)}, nil
+}
+
+type tproxyTCPListener struct {
+	l *net.TCPListener
+}
+
+func (l *tproxyTCPListener) accept() (libproxy.Conn, error) {
+	conn, err := l.l.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+	dst, err := tcpOriginalDst(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &tproxyTCPConn{conn, dst}, nil
+}
+
+func (l *tproxyTCPListener) close() error {
+	return l.l.Close()
+}
+
+// tproxyTCPConn is a Conn tagged with the destination the client actually
+// dialed, recovered from SO_ORIGINAL_DST, for use in place of the port's
+// static InIP/InPort when dialing out through the multiplexer.
+type tproxyTCPConn struct {
+	*net.TCPConn
+	dst libproxy.Destination
+}
+
+func (c *tproxyTCPConn) destination() libproxy.Destination {
+	return c.dst
+}
+
+func tcpOriginalDst(conn *net.TCPConn) (libproxy.Destination, error) {
+	f, err := conn.File()
+	if err != nil {
+		return libproxy.Destination{}, err
+	}
+	defer f.Close()
+	// SO_ORIGINAL_DST returns a 16-byte struct sockaddr_in; GetsockoptIPv6Mreq
+	// reads a 20-byte blob, large enough to hold it, and is the conventional
+	// way to fetch it without cgo.
+	raw, err := syscall.GetsockoptIPv6Mreq(int(f.Fd()), syscall.SOL_IP, soOriginalDst)
+	if err != nil {
+		return libproxy.Destination{}, err
+	}
+	ip := net.IPv4(raw.Multiaddr[4], raw.Multiaddr[5], raw.Multiaddr[6], raw.Multiaddr[7])
+	port := int(raw.Multiaddr[2])<<8 | int(raw.Multiaddr[3])
+	return libproxy.Destination{Proto: libproxy.TCP, IP: ip, Port: uint16(port)}, nil
+}
+
+func makeTCPTProxy(c common) (Forward, error) {
+	return makeStream(c, &tproxyTCPNetwork{})
+}
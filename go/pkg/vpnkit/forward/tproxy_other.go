@@ -0,0 +1,13 @@
+// +build !linux
+
+package forward
+
+import "errors"
+
+func makeTCPTProxy(c common) (Forward, error) {
+	return nil, errors.New("tproxy only supported on Linux")
+}
+
+func makeUDPTProxy(c common) (Forward, error) {
+	return nil, errors.New("tproxy only supported on Linux")
+}
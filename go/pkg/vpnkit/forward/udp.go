@@ -0,0 +1,182 @@
+package forward
+
+// Listen on a UDP socket and forward each client's datagrams to a remote
+// multiplexer, keeping a NAT-like session per client address for as long as
+// datagrams keep flowing. Works the same on every platform net.ListenUDP
+// supports.
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/moby/vpnkit/go/pkg/libproxy"
+	"github.com/moby/vpnkit/go/pkg/vpnkit"
+)
+
+// udpSessionIdleTimeout is how long a client's NAT-like session is kept
+// around, with no datagrams in either direction, before it's torn down.
+// Shared with the Linux TPROXY UDP forward.
+const udpSessionIdleTimeout = 60 * time.Second
+
+func makeUDP(c common) (Forward, error) {
+	conn, err := udpPacketConn(c.port)
+	if err != nil {
+		return nil, err
+	}
+	return &udp{common: c, conn: conn, sessions: map[string]*udpClientSession{}}, nil
+}
+
+func udpPacketConn(port vpnkit.Port) (net.PacketConn, error) {
+	if port.InheritFD != "" {
+		return inheritedPacketConn(port.InheritFD)
+	}
+	return net.ListenUDP("udp", &net.UDPAddr{IP: port.OutIP, Port: int(port.OutPort)})
+}
+
+// udpClientSession is a NAT-like mapping between one client address and the
+// mux connection dialed on its behalf, kept alive only while datagrams are
+// flowing in either direction.
+type udpClientSession struct {
+	addr       net.Addr
+	dest       libproxy.Destination
+	conn       libproxy.Conn
+	mu         sync.Mutex
+	lastActive time.Time
+}
+
+func (s *udpClientSession) touch() {
+	s.mu.Lock()
+	s.lastActive = time.Now()
+	s.mu.Unlock()
+}
+
+func (s *udpClientSession) idleSince() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Since(s.lastActive)
+}
+
+type udp struct {
+	common
+	conn     net.PacketConn
+	mu       sync.Mutex
+	sessions map[string]*udpClientSession
+}
+
+func (u *udp) Run() {
+	go u.reapIdleSessions()
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, from, err := u.conn.ReadFrom(buf)
+		if err != nil {
+			log.Printf("Stopping accepting datagrams on %s: %s", u.port.String(), err)
+			return
+		}
+		u.forward(buf[:n], from)
+	}
+}
+
+func (u *udp) forward(data []byte, from net.Addr) {
+	key := from.String()
+	u.mu.Lock()
+	s, ok := u.sessions[key]
+	u.mu.Unlock()
+	if !ok {
+		target := u.picker.Pick()
+		conn, err := u.ctrl.Mux().Dial(target)
+		if obs, ok := u.picker.(dialObserver); ok {
+			obs.Observe(target, err)
+		}
+		if err != nil {
+			log.Printf("unable to connect on %s: %s", u.port.String(), err)
+			if r, ok := u.picker.(releaser); ok {
+				r.Release(target)
+			}
+			return
+		}
+		s = &udpClientSession{addr: from, dest: target, conn: conn, lastActive: time.Now()}
+		u.mu.Lock()
+		u.sessions[key] = s
+		u.mu.Unlock()
+		go u.relayReplies(key, s)
+	}
+	s.touch()
+	if _, err := s.conn.Write(data); err != nil {
+		log.Printf("unable to forward datagram on %s: %s", u.port.String(), err)
+	}
+}
+
+// relayReplies is the backend-to-client direction: it reads whatever the mux
+// connection sends back and writes it out to the original client address,
+// until the connection errors or the session is reaped.
+func (u *udp) relayReplies(key string, s *udpClientSession) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := s.conn.Read(buf)
+		if err != nil {
+			u.closeSession(key)
+			return
+		}
+		s.touch()
+		if _, err := u.conn.WriteTo(buf[:n], s.addr); err != nil {
+			log.Printf("unable to send reply on %s: %s", u.port.String(), err)
+			u.closeSession(key)
+			return
+		}
+	}
+}
+
+func (u *udp) closeSession(key string) {
+	u.mu.Lock()
+	s, ok := u.sessions[key]
+	if ok {
+		delete(u.sessions, key)
+	}
+	u.mu.Unlock()
+	if ok {
+		s.conn.Close()
+		if r, ok := u.picker.(releaser); ok {
+			r.Release(s.dest)
+		}
+	}
+}
+
+// reapIdleSessions tears down sessions that have seen no traffic in either
+// direction for udpSessionIdleTimeout, so a client that vanishes doesn't
+// leak a mux connection forever.
+func (u *udp) reapIdleSessions() {
+	t := time.NewTicker(udpSessionIdleTimeout / 4)
+	defer t.Stop()
+	for {
+		select {
+		case <-u.quit:
+			return
+		case <-t.C:
+			u.mu.Lock()
+			idle := make([]string, 0)
+			for key, s := range u.sessions {
+				if s.idleSince() >= udpSessionIdleTimeout {
+					idle = append(idle, key)
+				}
+			}
+			u.mu.Unlock()
+			for _, key := range idle {
+				u.closeSession(key)
+			}
+		}
+	}
+}
+
+func (u *udp) Stop() {
+	log.Printf("Removing %s", u.port.String())
+	close(u.quit)
+	u.conn.Close()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, s := range u.sessions {
+		s.conn.Close()
+	}
+}
@@ -0,0 +1,269 @@
+// +build linux
+
+package forward
+
+// A Linux-only UDP listener that binds with IP_TRANSPARENT/IP_RECVORIGDSTADDR
+// so a single socket can receive datagrams addressed to any IP in a routed
+// subnet, and recovers each datagram's original destination from the
+// IP_RECVORIGDSTADDR ancillary message delivered alongside it.
+//
+// IPv4 only: the IPV6_TRANSPARENT/IPV6_RECVORIGDSTADDR equivalents for
+// routed IPv6 subnets aren't implemented yet. parseOrigDst and replySocket
+// both assume an AF_INET destination.
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/moby/vpnkit/go/pkg/libproxy"
+	"github.com/moby/vpnkit/go/pkg/vpnkit"
+	"golang.org/x/sys/unix"
+)
+
+func makeUDPTProxy(c common) (Forward, error) {
+	fd, err := tproxyUDPSocket(c.port)
+	if err != nil {
+		return nil, err
+	}
+	return &udpTProxy{common: c, fd: fd, sessions: map[string]*udpSession{}}, nil
+}
+
+// tproxyUDPSocket opens and binds a UDP socket with IP_TRANSPARENT set, so it
+// can accept datagrams for any address in a routed subnet, and
+// IP_RECVORIGDSTADDR, so recvmsg reports each datagram's real destination.
+func tproxyUDPSocket(port vpnkit.Port) (int, error) {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return -1, err
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_IP, syscall.IP_TRANSPARENT, 1); err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_IP, unix.IP_RECVORIGDSTADDR, 1); err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+	addr := syscall.SockaddrInet4{Port: int(port.OutPort)}
+	copy(addr.Addr[:], port.OutIP.To4())
+	if err := syscall.Bind(fd, &addr); err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+// udpSession is a NAT-like mapping between one client address and the mux
+// connection dialed on its behalf, kept alive only while datagrams are
+// flowing in either direction.
+type udpSession struct {
+	dest       libproxy.Destination
+	from       syscall.Sockaddr
+	conn       libproxy.Conn
+	replyFD    int
+	mu         sync.Mutex
+	lastActive time.Time
+}
+
+func (s *udpSession) touch() {
+	s.mu.Lock()
+	s.lastActive = time.Now()
+	s.mu.Unlock()
+}
+
+func (s *udpSession) idleSince() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Since(s.lastActive)
+}
+
+type udpTProxy struct {
+	common
+	fd       int
+	mu       sync.Mutex
+	sessions map[string]*udpSession
+}
+
+func (u *udpTProxy) Run() {
+	go u.reapIdleSessions()
+
+	buf := make([]byte, 64*1024)
+	oob := make([]byte, 1024)
+	for {
+		n, oobn, _, from, err := syscall.Recvmsg(u.fd, buf, oob, 0)
+		if err != nil {
+			log.Printf("Stopping accepting datagrams on %s: %s", u.port.String(), err)
+			return
+		}
+		dst, err := parseOrigDst(oob[:oobn])
+		if err != nil {
+			log.Printf("unable to recover original destination on %s: %s", u.port.String(), err)
+			continue
+		}
+		u.forward(buf[:n], dst, from)
+	}
+}
+
+func parseOrigDst(oob []byte) (libproxy.Destination, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return libproxy.Destination{}, err
+	}
+	for _, m := range msgs {
+		if m.Header.Level != syscall.SOL_IP || m.Header.Type != unix.IP_RECVORIGDSTADDR {
+			continue
+		}
+		sa, err := unix.ParseOrigDstAddr(&m)
+		if err != nil {
+			return libproxy.Destination{}, err
+		}
+		if sa4, ok := sa.(*unix.SockaddrInet4); ok {
+			return libproxy.Destination{
+				Proto: libproxy.UDP,
+				IP:    net.IPv4(sa4.Addr[0], sa4.Addr[1], sa4.Addr[2], sa4.Addr[3]),
+				Port:  uint16(sa4.Port),
+			}, nil
+		}
+	}
+	return libproxy.Destination{}, syscall.ENOENT
+}
+
+func sessionKey(from syscall.Sockaddr) string {
+	addr := from.(*syscall.SockaddrInet4)
+	return fmt.Sprintf("%v:%d", addr.Addr, addr.Port)
+}
+
+// replySocket opens a second IP_TRANSPARENT socket bound to dest and
+// connected to from, so replies written to it carry dest as their source
+// address rather than u.fd's own bound address. Sending replies straight
+// out u.fd would silently drop the "original destination" vpnkit went to
+// the trouble of recovering via IP_RECVORIGDSTADDR in the first place.
+func replySocket(dest libproxy.Destination, from syscall.Sockaddr) (int, error) {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return -1, err
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_IP, syscall.IP_TRANSPARENT, 1); err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+	bind := syscall.SockaddrInet4{Port: int(dest.Port)}
+	copy(bind.Addr[:], dest.IP.To4())
+	if err := syscall.Bind(fd, &bind); err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+	if err := syscall.Connect(fd, from); err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+func (u *udpTProxy) forward(data []byte, dest libproxy.Destination, from syscall.Sockaddr) {
+	key := sessionKey(from)
+	u.mu.Lock()
+	s, ok := u.sessions[key]
+	u.mu.Unlock()
+	if !ok {
+		conn, err := u.ctrl.Mux().Dial(dest)
+		if err != nil {
+			log.Printf("unable to connect on %s: %s", u.port.String(), err)
+			return
+		}
+		replyFD, err := replySocket(dest, from)
+		if err != nil {
+			log.Printf("unable to open reply socket on %s: %s", u.port.String(), err)
+			conn.Close()
+			return
+		}
+		s = &udpSession{dest: dest, from: from, conn: conn, replyFD: replyFD, lastActive: time.Now()}
+		u.mu.Lock()
+		u.sessions[key] = s
+		u.mu.Unlock()
+		go u.relayReplies(key, s)
+	}
+	s.touch()
+	if _, err := s.conn.Write(data); err != nil {
+		log.Printf("unable to forward datagram on %s: %s", u.port.String(), err)
+	}
+}
+
+// relayReplies is the backend-to-client direction: it reads whatever the mux
+// connection sends back and writes it out s.replyFD, which is bound to the
+// original destination and connected to the client, so the reply's source
+// address is preserved. It runs until the connection errors or the session
+// is reaped.
+func (u *udpTProxy) relayReplies(key string, s *udpSession) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := s.conn.Read(buf)
+		if err != nil {
+			u.closeSession(key)
+			return
+		}
+		s.touch()
+		if err := syscall.Sendto(s.replyFD, buf[:n], 0, nil); err != nil {
+			log.Printf("unable to send reply on %s: %s", u.port.String(), err)
+			u.closeSession(key)
+			return
+		}
+	}
+}
+
+func (u *udpTProxy) closeSession(key string) {
+	u.mu.Lock()
+	s, ok := u.sessions[key]
+	if ok {
+		delete(u.sessions, key)
+	}
+	u.mu.Unlock()
+	if ok {
+		s.conn.Close()
+		syscall.Close(s.replyFD)
+		if r, ok := u.picker.(releaser); ok {
+			r.Release(s.dest)
+		}
+	}
+}
+
+// reapIdleSessions tears down sessions that have seen no traffic in either
+// direction for udpSessionIdleTimeout, so a client that vanishes doesn't
+// leak a mux connection forever.
+func (u *udpTProxy) reapIdleSessions() {
+	t := time.NewTicker(udpSessionIdleTimeout / 4)
+	defer t.Stop()
+	for {
+		select {
+		case <-u.quit:
+			return
+		case <-t.C:
+			u.mu.Lock()
+			idle := make([]string, 0)
+			for key, s := range u.sessions {
+				if s.idleSince() >= udpSessionIdleTimeout {
+					idle = append(idle, key)
+				}
+			}
+			u.mu.Unlock()
+			for _, key := range idle {
+				u.closeSession(key)
+			}
+		}
+	}
+}
+
+func (u *udpTProxy) Stop() {
+	log.Printf("Removing %s", u.port.String())
+	close(u.quit)
+	syscall.Close(u.fd)
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, s := range u.sessions {
+		s.conn.Close()
+	}
+}
@@ -15,6 +15,17 @@ import (
 type unixNetwork struct{}
 
 func (t *unixNetwork) listen(port vpnkit.Port) (listener, error) {
+	if port.InheritFD != "" {
+		l, err := inheritedListener(port.InheritFD)
+		if err != nil {
+			return nil, err
+		}
+		ul, ok := l.(*net.UnixListener)
+		if !ok {
+			return nil, errors.New("inherited fd " + port.InheritFD + " is not a Unix socket")
+		}
+		return &unixListener{ul}, nil
+	}
 	if err := removeExistingSocket(port.OutPath); err != nil {
 		return nil, err
 	}